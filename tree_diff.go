@@ -1,11 +1,19 @@
 package hercules
 
 import (
+	"bytes"
 	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
 	"strings"
 
 	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
 	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/utils/merkletrie"
+	"gopkg.in/src-d/go-git.v4/utils/merkletrie/noder"
 )
 
 // TreeDiff generates the list of changes for a commit. A change can be either one or two blobs
@@ -14,18 +22,104 @@ import (
 // TreeDiff is a PipelineItem.
 type TreeDiff struct {
 	previousTree *object.Tree
-	SkipDirs     []string
+	repository   *git.Repository
+	// baseTreeErr is set by Initialize() if BaseHash/BaseRef could not be resolved to a
+	// tree; Consume() returns it on the very first call instead of silently treating the
+	// first commit as an all-add.
+	baseTreeErr error
+	// blobCache avoids re-fetching the same blob contents twice while scoring rename
+	// candidates within a single detectRenames() call. It is rebuilt from scratch every
+	// call, so it never grows beyond one commit's candidate set.
+	blobCache map[plumbing.Hash][]byte
+	SkipDirs  []string
+
+	// DetectRenames enables pairing of deletes and adds which refer to the same file
+	// identity into a single rename change instead of two independent changes. Copies are
+	// not detected: an add whose source file still exists stays a plain add.
+	DetectRenames bool
+	// RenameSimilarityThreshold is the minimum blob similarity, in percent [0, 100],
+	// required to consider a delete+add pair a rename. Only consulted if DetectRenames
+	// is set.
+	RenameSimilarityThreshold int
+
+	// IncludeSubmodules makes gitlink entries (submodules) appear as their own changes
+	// instead of being silently treated as modifications of an empty blob.
+	IncludeSubmodules bool
+	// ReportModeChanges makes a change appear when only the file mode changed between
+	// the two trees (e.g. chmod +x), even though the blob contents are identical.
+	ReportModeChanges bool
+	// PathSpec, if not empty, is a list of "/"-separated glob patterns (with "**" matching
+	// zero or more path segments, e.g. "backend/**") matched against the changed path; only
+	// changes with a matching path are kept. Non-matching subtrees are pruned while the two
+	// trees are being traversed; the all-add changes of a first commit without a base tree
+	// are filtered afterwards. An empty PathSpec keeps everything.
+	PathSpec []string
+
+	// BaseHash, if not empty, is the SHA of the commit whose tree the very first Consume()
+	// call is diffed against, instead of treating the first commit as an all-add against
+	// the empty tree. Takes precedence over BaseRef if both are set.
+	BaseHash string
+	// BaseRef, if not empty and BaseHash is not set, is a branch or tag name resolved to a
+	// commit whose tree the very first Consume() call is diffed against.
+	BaseRef string
+
+	// IncludeDirs, if not empty, is a whitelist of path prefixes; only changes under one of
+	// these prefixes are kept. An empty IncludeDirs keeps everything, subject to SkipDirs.
+	IncludeDirs []string
+	// RespectLinguistAttrs enables reading .gitattributes from the commit's tree and
+	// dropping changes whose path is marked linguist-generated, linguist-vendored or
+	// linguist-documentation.
+	RespectLinguistAttrs bool
+	// attrsCache memoizes the parsed .gitattributes rules by tree hash, since most
+	// consecutive commits share the same .gitattributes. Initialize() clears it so it
+	// never carries rules forward from a previous repository.
+	attrsCache map[plumbing.Hash][]gitattributeRule
 }
 
 const (
 	// DependencyTreeChanges is the name of the dependency provided by TreeDiff.
 	DependencyTreeChanges = "changes"
+	// DependencyRenames is the name of the dependency provided by TreeDiff which maps
+	// a renamed change to its similarity score in percent [0, 100]. Only changes
+	// detected as renames are present in this map; plain adds, deletes and modifications
+	// are not.
+	DependencyRenames = "renames"
 	// ConfigTreeDiffSkipBlacklist is the name of the configuration option
 	// (TreeDiff.Configure()) which allows to skip blacklist directories.
 	ConfigTreeDiffSkipBlacklist = "TreeDiff.SkipVendor"
 	// ConfigTreeDiffBlacklistedDirs s the name of the configuration option
 	// (TreeDiff.Configure()) which allows to set blacklist directories.
 	ConfigTreeDiffBlacklistedDirs = "TreeDiff.BlacklistedDirs"
+	// ConfigTreeDiffDetectRenames is the name of the configuration option
+	// (TreeDiff.Configure()) which enables rename detection.
+	ConfigTreeDiffDetectRenames = "TreeDiff.DetectRenames"
+	// ConfigTreeDiffRenameSimilarityThreshold is the name of the configuration option
+	// (TreeDiff.Configure()) which sets the minimum similarity percentage for two blobs
+	// to be considered a rename.
+	ConfigTreeDiffRenameSimilarityThreshold = "TreeDiff.RenameSimilarityThreshold"
+	// ConfigTreeDiffIncludeSubmodules is the name of the configuration option
+	// (TreeDiff.Configure()) which makes submodule entries appear as their own changes.
+	ConfigTreeDiffIncludeSubmodules = "TreeDiff.IncludeSubmodules"
+	// ConfigTreeDiffReportModeChanges is the name of the configuration option
+	// (TreeDiff.Configure()) which makes mode-only changes appear as changes.
+	ConfigTreeDiffReportModeChanges = "TreeDiff.ReportModeChanges"
+	// ConfigTreeDiffPathSpec is the name of the configuration option (TreeDiff.Configure())
+	// which restricts the considered changes to paths matching a list of glob patterns.
+	ConfigTreeDiffPathSpec = "TreeDiff.PathSpec"
+	// ConfigTreeDiffBaseHash is the name of the configuration option (TreeDiff.Configure())
+	// which sets the SHA of the commit whose tree the first commit is diffed against.
+	ConfigTreeDiffBaseHash = "TreeDiff.BaseHash"
+	// ConfigTreeDiffBaseRef is the name of the configuration option (TreeDiff.Configure())
+	// which sets the branch or tag name whose tree the first commit is diffed against.
+	ConfigTreeDiffBaseRef = "TreeDiff.BaseRef"
+	// ConfigTreeDiffIncludeDirs is the name of the configuration option
+	// (TreeDiff.Configure()) which sets the path prefix whitelist.
+	ConfigTreeDiffIncludeDirs = "TreeDiff.IncludeDirs"
+	// ConfigTreeDiffRespectLinguistAttrs is the name of the configuration option
+	// (TreeDiff.Configure()) which enables .gitattributes-based linguist exclusion.
+	ConfigTreeDiffRespectLinguistAttrs = "TreeDiff.RespectLinguistAttrs"
+	// DefaultRenameSimilarityThreshold is RenameSimilarityThreshold's value by default.
+	DefaultRenameSimilarityThreshold = 50
 )
 
 var defaultBlacklistedDirs = []string{"vendor/", "vendors/", "node_modules/"}
@@ -39,7 +133,7 @@ func (treediff *TreeDiff) Name() string {
 // Each produced entity will be inserted into `deps` of dependent Consume()-s according
 // to this list. Also used by hercules.Registry to build the global map of providers.
 func (treediff *TreeDiff) Provides() []string {
-	arr := [...]string{DependencyTreeChanges}
+	arr := [...]string{DependencyTreeChanges, DependencyRenames}
 	return arr[:]
 }
 
@@ -62,7 +156,52 @@ func (treediff *TreeDiff) ListConfigurationOptions() []ConfigurationOption {
 		Description: "List of blacklist directories. Separated by comma \",\".",
 		Flag:        "blacklisted-dirs",
 		Type:        StringsConfigurationOption,
-		Default:     defaultBlacklistedDirs},
+		Default:     defaultBlacklistedDirs}, {
+		Name:        ConfigTreeDiffDetectRenames,
+		Description: "Detect renames instead of reporting them as an add and a delete.",
+		Flag:        "detect-renames",
+		Type:        BoolConfigurationOption,
+		Default:     false}, {
+		Name:        ConfigTreeDiffRenameSimilarityThreshold,
+		Description: "Minimum blob similarity, in percents, to consider a pair of add+delete a rename.",
+		Flag:        "rename-similarity-threshold",
+		Type:        IntConfigurationOption,
+		Default:     DefaultRenameSimilarityThreshold}, {
+		Name:        ConfigTreeDiffIncludeSubmodules,
+		Description: "Report submodule (gitlink) entries as their own changes.",
+		Flag:        "include-submodules",
+		Type:        BoolConfigurationOption,
+		Default:     false}, {
+		Name:        ConfigTreeDiffReportModeChanges,
+		Description: "Report a change when only the file mode differs, e.g. chmod +x.",
+		Flag:        "report-mode-changes",
+		Type:        BoolConfigurationOption,
+		Default:     false}, {
+		Name:        ConfigTreeDiffPathSpec,
+		Description: "List of \"/\"-separated glob patterns (\"**\" matches zero or more segments) to restrict the analysed paths to. Separated by comma \",\".",
+		Flag:        "pathspec",
+		Type:        StringsConfigurationOption,
+		Default:     []string{}}, {
+		Name:        ConfigTreeDiffBaseHash,
+		Description: "SHA of the commit whose tree the very first commit is diffed against, instead of the empty tree.",
+		Flag:        "base-hash",
+		Type:        StringConfigurationOption,
+		Default:     ""}, {
+		Name:        ConfigTreeDiffBaseRef,
+		Description: "Branch or tag to diff the very first commit against, instead of the empty tree.",
+		Flag:        "base-ref",
+		Type:        StringConfigurationOption,
+		Default:     ""}, {
+		Name:        ConfigTreeDiffIncludeDirs,
+		Description: "Whitelist of path prefixes to keep. Separated by comma \",\". Empty means keep everything.",
+		Flag:        "include-dirs",
+		Type:        StringsConfigurationOption,
+		Default:     []string{}}, {
+		Name:        ConfigTreeDiffRespectLinguistAttrs,
+		Description: "Drop changes marked linguist-generated, linguist-vendored or linguist-documentation in .gitattributes.",
+		Flag:        "respect-linguist-attrs",
+		Type:        BoolConfigurationOption,
+		Default:     false},
 	}
 	return options[:]
 }
@@ -72,12 +211,311 @@ func (treediff *TreeDiff) Configure(facts map[string]interface{}) {
 	if val, exists := facts[ConfigTreeDiffSkipBlacklist]; exists && val.(bool) == true {
 		treediff.SkipDirs = facts[ConfigTreeDiffBlacklistedDirs].([]string)
 	}
+	if val, exists := facts[ConfigTreeDiffDetectRenames]; exists {
+		treediff.DetectRenames = val.(bool)
+	}
+	if val, exists := facts[ConfigTreeDiffRenameSimilarityThreshold]; exists {
+		treediff.RenameSimilarityThreshold = val.(int)
+	} else if treediff.RenameSimilarityThreshold == 0 {
+		treediff.RenameSimilarityThreshold = DefaultRenameSimilarityThreshold
+	}
+	if val, exists := facts[ConfigTreeDiffIncludeSubmodules]; exists {
+		treediff.IncludeSubmodules = val.(bool)
+	}
+	if val, exists := facts[ConfigTreeDiffReportModeChanges]; exists {
+		treediff.ReportModeChanges = val.(bool)
+	}
+	if val, exists := facts[ConfigTreeDiffPathSpec]; exists {
+		treediff.PathSpec = val.([]string)
+	}
+	if val, exists := facts[ConfigTreeDiffBaseHash]; exists {
+		treediff.BaseHash = val.(string)
+	}
+	if val, exists := facts[ConfigTreeDiffBaseRef]; exists {
+		treediff.BaseRef = val.(string)
+	}
+	if val, exists := facts[ConfigTreeDiffIncludeDirs]; exists {
+		treediff.IncludeDirs = val.([]string)
+	}
+	if val, exists := facts[ConfigTreeDiffRespectLinguistAttrs]; exists {
+		treediff.RespectLinguistAttrs = val.(bool)
+	}
 }
 
 // Initialize resets the temporary caches and prepares this PipelineItem for a series of Consume()
 // calls. The repository which is going to be analysed is supplied as an argument.
 func (treediff *TreeDiff) Initialize(repository *git.Repository) {
 	treediff.previousTree = nil
+	treediff.repository = repository
+	treediff.baseTreeErr = nil
+	treediff.blobCache = nil
+	treediff.attrsCache = nil
+	if treediff.BaseHash == "" && treediff.BaseRef == "" {
+		return
+	}
+	treediff.previousTree, treediff.baseTreeErr = resolveBaseTree(
+		repository, treediff.BaseHash, treediff.BaseRef)
+}
+
+// resolveBaseTree resolves BaseHash, or BaseRef if BaseHash is empty, to the tree of the
+// commit it points to.
+func resolveBaseTree(repository *git.Repository, hash, ref string) (*object.Tree, error) {
+	commitHash := plumbing.NewHash(hash)
+	if hash == "" {
+		resolved, err := repository.ResolveRevision(plumbing.Revision(ref))
+		if err != nil {
+			return nil, err
+		}
+		commitHash = *resolved
+	}
+	commit, err := repository.CommitObject(commitHash)
+	if err != nil {
+		return nil, err
+	}
+	return commit.Tree()
+}
+
+// diffTrees computes the changes between two trees by walking them as merkletrie noders,
+// the same strategy go-git itself settled on, instead of go-git's plain hash-matching
+// object.DiffTree(). Noders only carry paths and hashes, so each merkletrie.Change is
+// resolved back against `from`/`to` to recover an object.Change with a proper TreeEntry.
+// When PathSpec is set, the noders are wrapped so that non-matching subtrees are pruned
+// while merkletrie.DiffTree is still traversing them, rather than discarding changes
+// after the full diff has already been computed.
+func (treediff *TreeDiff) diffTrees(from, to *object.Tree) (object.Changes, error) {
+	var fromNoder, toNoder noder.Noder = object.NewTreeRootNode(from), object.NewTreeRootNode(to)
+	if len(treediff.PathSpec) > 0 {
+		patterns := compileGlobPatterns(treediff.PathSpec)
+		fromNoder = newPathSpecNoder(fromNoder, patterns)
+		toNoder = newPathSpecNoder(toNoder, patterns)
+	}
+	merkletrieChanges, err := merkletrie.DiffTree(fromNoder, toNoder, noderHashEquals)
+	if err != nil {
+		return nil, err
+	}
+	changes := make(object.Changes, 0, len(merkletrieChanges))
+	for _, mc := range merkletrieChanges {
+		change, err := treediff.adaptMerkletrieChange(from, to, mc)
+		if err != nil {
+			return nil, err
+		}
+		if change != nil {
+			changes = append(changes, change)
+		}
+	}
+	return changes, nil
+}
+
+// noderHashEquals is the equality predicate merkletrie.DiffTree() uses to decide that two
+// tree entries at the same path are unchanged.
+func noderHashEquals(a, b noder.Hasher) bool {
+	return bytes.Equal(a.Hash(), b.Hash())
+}
+
+// adaptMerkletrieChange converts one merkletrie.Change back into an object.Change, resolving
+// the concrete TreeEntry on each side from `from`/`to`. It applies IncludeSubmodules and
+// ReportModeChanges, and returns a nil change (not an error) for anything filtered out.
+// PathSpec has already been applied at traversal time by pathSpecNoder, before this change
+// was even produced.
+func (treediff *TreeDiff) adaptMerkletrieChange(
+	from, to *object.Tree, mc merkletrie.Change) (*object.Change, error) {
+
+	path := changePath(mc)
+	var fromEntry, toEntry object.ChangeEntry
+	if len(mc.From) > 0 {
+		entry, err := from.FindEntry(path)
+		if err != nil {
+			return nil, err
+		}
+		if entry.Mode != filemode.Submodule || treediff.IncludeSubmodules {
+			fromEntry = object.ChangeEntry{Name: path, Tree: from, TreeEntry: *entry}
+		}
+	}
+	if len(mc.To) > 0 {
+		entry, err := to.FindEntry(path)
+		if err != nil {
+			return nil, err
+		}
+		if entry.Mode != filemode.Submodule || treediff.IncludeSubmodules {
+			toEntry = object.ChangeEntry{Name: path, Tree: to, TreeEntry: *entry}
+		}
+	}
+	if fromEntry.TreeEntry.Hash.IsZero() && toEntry.TreeEntry.Hash.IsZero() {
+		// Each side is either absent or a gitlink, and submodules are not being tracked.
+		return nil, nil
+	}
+	isModeOnlyChange := len(mc.From) > 0 && len(mc.To) > 0 &&
+		fromEntry.TreeEntry.Hash == toEntry.TreeEntry.Hash &&
+		fromEntry.TreeEntry.Mode != toEntry.TreeEntry.Mode
+	if isModeOnlyChange && !treediff.ReportModeChanges {
+		return nil, nil
+	}
+	return &object.Change{From: fromEntry, To: toEntry}, nil
+}
+
+// changePath returns the path a merkletrie.Change refers to, preferring the destination
+// side so that additions and modifications report the new path.
+func changePath(mc merkletrie.Change) string {
+	if len(mc.To) > 0 {
+		return mc.To.String()
+	}
+	return mc.From.String()
+}
+
+// globPattern is a single "/"-separated glob pattern compiled for segment-aware matching.
+// Unlike path/filepath.Match, a "**" segment matches zero or more whole path segments, so
+// e.g. "backend/**" matches "backend/a/b/c.go", and a pattern without any "/" matches its
+// basename at any directory depth, mirroring .gitignore/.gitattributes semantics.
+type globPattern struct {
+	segments []string
+	anchored bool
+}
+
+// compileGlobPattern parses a single glob pattern into a globPattern.
+func compileGlobPattern(pattern string) globPattern {
+	return globPattern{
+		segments: strings.Split(strings.Trim(pattern, "/"), "/"),
+		anchored: strings.Contains(pattern, "/"),
+	}
+}
+
+// compileGlobPatterns parses a list of glob patterns.
+func compileGlobPatterns(patterns []string) []globPattern {
+	compiled := make([]globPattern, len(patterns))
+	for i, pattern := range patterns {
+		compiled[i] = compileGlobPattern(pattern)
+	}
+	return compiled
+}
+
+// matches reports whether `path` matches this pattern in full.
+func (p globPattern) matches(path string) bool {
+	pathSegments := strings.Split(path, "/")
+	if p.anchored {
+		return globMatchSegments(p.segments, pathSegments)
+	}
+	for start := 0; start <= len(pathSegments); start++ {
+		if globMatchSegments(p.segments, pathSegments[start:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// canMatchPrefix reports whether some path starting with `prefixSegments` could still match
+// this pattern, i.e. whether it is worth descending into a directory at that prefix.
+func (p globPattern) canMatchPrefix(prefixSegments []string) bool {
+	if !p.anchored {
+		// An unanchored pattern can start matching at any depth not yet reached.
+		return true
+	}
+	return globCanMatchPrefix(p.segments, prefixSegments)
+}
+
+// globMatchSegments reports whether patternSegments matches pathSegments exactly, treating a
+// "**" segment as zero or more path segments.
+func globMatchSegments(patternSegments, pathSegments []string) bool {
+	if len(patternSegments) == 0 {
+		return len(pathSegments) == 0
+	}
+	if patternSegments[0] == "**" {
+		if globMatchSegments(patternSegments[1:], pathSegments) {
+			return true
+		}
+		if len(pathSegments) == 0 {
+			return false
+		}
+		return globMatchSegments(patternSegments, pathSegments[1:])
+	}
+	if len(pathSegments) == 0 {
+		return false
+	}
+	if matched, _ := filepath.Match(patternSegments[0], pathSegments[0]); !matched {
+		return false
+	}
+	return globMatchSegments(patternSegments[1:], pathSegments[1:])
+}
+
+// globCanMatchPrefix reports whether patternSegments could still match some path that starts
+// with prefixSegments, used to decide whether a directory is worth traversing.
+func globCanMatchPrefix(patternSegments, prefixSegments []string) bool {
+	if len(prefixSegments) == 0 {
+		return true
+	}
+	if len(patternSegments) == 0 {
+		return false
+	}
+	if patternSegments[0] == "**" {
+		return true
+	}
+	if matched, _ := filepath.Match(patternSegments[0], prefixSegments[0]); !matched {
+		return false
+	}
+	return globCanMatchPrefix(patternSegments[1:], prefixSegments[1:])
+}
+
+// pathSpecNoder wraps a noder.Noder so that Children() prunes entries that cannot match any
+// of patterns, letting merkletrie.DiffTree skip whole non-matching subtrees instead of
+// walking them just to have their changes discarded afterwards.
+type pathSpecNoder struct {
+	noder.Noder
+	prefix   []string
+	patterns []globPattern
+}
+
+// newPathSpecNoder wraps the root noder of a tree for PathSpec-aware traversal.
+func newPathSpecNoder(root noder.Noder, patterns []globPattern) noder.Noder {
+	return &pathSpecNoder{Noder: root, patterns: patterns}
+}
+
+// Children returns only the children whose subtree might contain a path matching patterns.
+func (n *pathSpecNoder) Children() ([]noder.Noder, error) {
+	children, err := n.Noder.Children()
+	if err != nil {
+		return nil, err
+	}
+	filtered := make([]noder.Noder, 0, len(children))
+	for _, child := range children {
+		childPrefix := append(append([]string{}, n.prefix...), child.Name())
+		if child.IsDir() {
+			if anyCanMatchPrefix(n.patterns, childPrefix) {
+				filtered = append(filtered, &pathSpecNoder{Noder: child, prefix: childPrefix, patterns: n.patterns})
+			}
+		} else if anyMatches(n.patterns, childPrefix) {
+			filtered = append(filtered, &pathSpecNoder{Noder: child, prefix: childPrefix, patterns: n.patterns})
+		}
+	}
+	return filtered, nil
+}
+
+// NumChildren reports the number of children that survive PathSpec pruning.
+func (n *pathSpecNoder) NumChildren() (int, error) {
+	children, err := n.Children()
+	if err != nil {
+		return 0, err
+	}
+	return len(children), nil
+}
+
+// anyMatches reports whether any pattern fully matches the path made of `segments`.
+func anyMatches(patterns []globPattern, segments []string) bool {
+	path := strings.Join(segments, "/")
+	for _, pattern := range patterns {
+		if pattern.matches(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// anyCanMatchPrefix reports whether any pattern could still match beneath `segments`.
+func anyCanMatchPrefix(patterns []globPattern, segments []string) bool {
+	for _, pattern := range patterns {
+		if pattern.canMatchPrefix(segments) {
+			return true
+		}
+	}
+	return false
 }
 
 // Consume runs this PipelineItem on the next commit data.
@@ -86,6 +524,9 @@ func (treediff *TreeDiff) Initialize(repository *git.Repository) {
 // This function returns the mapping with analysis results. The keys must be the same as
 // in Provides(). If there was an error, nil is returned.
 func (treediff *TreeDiff) Consume(deps map[string]interface{}) (map[string]interface{}, error) {
+	if treediff.baseTreeErr != nil {
+		return nil, treediff.baseTreeErr
+	}
 	commit := deps["commit"].(*object.Commit)
 	tree, err := commit.Tree()
 	if err != nil {
@@ -93,7 +534,7 @@ func (treediff *TreeDiff) Consume(deps map[string]interface{}) (map[string]inter
 	}
 	var diff object.Changes
 	if treediff.previousTree != nil {
-		diff, err = object.DiffTree(treediff.previousTree, tree)
+		diff, err = treediff.diffTrees(treediff.previousTree, tree)
 		if err != nil {
 			return nil, err
 		}
@@ -137,7 +578,375 @@ func (treediff *TreeDiff) Consume(deps map[string]interface{}) (map[string]inter
 
 		diff = filteredDiff
 	}
-	return map[string]interface{}{DependencyTreeChanges: diff}, nil
+
+	diff, err = treediff.filterPaths(diff, tree)
+	if err != nil {
+		return nil, err
+	}
+
+	renames := map[*object.Change]int{}
+	if treediff.DetectRenames {
+		diff, renames = treediff.detectRenames(diff)
+	}
+	return map[string]interface{}{
+		DependencyTreeChanges: diff,
+		DependencyRenames:     renames,
+	}, nil
+}
+
+// filterPaths applies PathSpec, IncludeDirs and, if RespectLinguistAttrs is set, the linguist
+// exclusion rules parsed from `tree`'s .gitattributes. A change is kept if it matches PathSpec
+// (when set), has no IncludeDirs prefix restriction (or satisfies one) and is not marked
+// linguist-generated, linguist-vendored or linguist-documentation.
+func (treediff *TreeDiff) filterPaths(diff object.Changes, tree *object.Tree) (object.Changes, error) {
+	if len(treediff.PathSpec) == 0 && len(treediff.IncludeDirs) == 0 && !treediff.RespectLinguistAttrs {
+		return diff, nil
+	}
+	patterns := compileGlobPatterns(treediff.PathSpec)
+	var attrs []gitattributeRule
+	if treediff.RespectLinguistAttrs {
+		var err error
+		attrs, err = treediff.linguistAttrs(tree)
+		if err != nil {
+			return nil, err
+		}
+	}
+	filteredDiff := diff[:0]
+OUTER:
+	for _, change := range diff {
+		names := changeNames(change)
+		if len(patterns) > 0 {
+			matched := false
+			for _, name := range names {
+				matched = matched || anyMatches(patterns, strings.Split(name, "/"))
+			}
+			if !matched {
+				continue OUTER
+			}
+		}
+		if len(treediff.IncludeDirs) > 0 && !anyHasPrefix(names, treediff.IncludeDirs) {
+			continue OUTER
+		}
+		if treediff.RespectLinguistAttrs {
+			for _, name := range names {
+				if isLinguistExcluded(attrs, name) {
+					continue OUTER
+				}
+			}
+		}
+		filteredDiff = append(filteredDiff, change)
+	}
+	return filteredDiff, nil
+}
+
+// changeNames returns the distinct non-empty path(s) a change refers to.
+func changeNames(change *object.Change) []string {
+	var names []string
+	if change.To.Name != "" {
+		names = append(names, change.To.Name)
+	}
+	if change.From.Name != "" && change.From.Name != change.To.Name {
+		names = append(names, change.From.Name)
+	}
+	return names
+}
+
+// anyHasPrefix reports whether any of `names` has one of `prefixes` as a prefix.
+func anyHasPrefix(names []string, prefixes []string) bool {
+	for _, name := range names {
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(name, prefix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// gitattributeRule is one parsed pattern line of a .gitattributes file, holding only the
+// linguist attributes TreeDiff cares about. A nil field means the line did not mention that
+// attribute; later rules override earlier ones for whichever attributes they do mention.
+// pattern is already resolved relative to the repository root, so matching never needs to
+// know which directory the rule's .gitattributes file came from.
+type gitattributeRule struct {
+	pattern       globPattern
+	generated     *bool
+	vendored      *bool
+	documentation *bool
+}
+
+// linguistAttrs returns the parsed .gitattributes rules of `tree`, memoized by tree hash.
+// Real git/linguist attributes are not confined to a single root file: every directory may
+// carry its own .gitattributes, and for a given path the rules of the deepest one found above
+// it take precedence. This walks the whole tree, collects every .gitattributes it finds and
+// concatenates their rules ordered from shallowest to deepest, so isLinguistExcluded's
+// later-rule-wins scan naturally lets the most specific file override its ancestors.
+func (treediff *TreeDiff) linguistAttrs(tree *object.Tree) ([]gitattributeRule, error) {
+	if rules, exists := treediff.attrsCache[tree.Hash]; exists {
+		return rules, nil
+	}
+	if treediff.attrsCache == nil {
+		treediff.attrsCache = map[plumbing.Hash][]gitattributeRule{}
+	}
+	var files []*object.File
+	fileIter := tree.Files()
+	defer fileIter.Close()
+	for {
+		file, err := fileIter.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if filepath.Base(file.Name) == ".gitattributes" {
+			files = append(files, file)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return strings.Count(files[i].Name, "/") < strings.Count(files[j].Name, "/")
+	})
+	var rules []gitattributeRule
+	for _, file := range files {
+		contents, err := file.Contents()
+		if err != nil {
+			return nil, err
+		}
+		dir := strings.TrimSuffix(strings.TrimSuffix(file.Name, ".gitattributes"), "/")
+		rules = append(rules, parseGitattributes(dir, contents)...)
+	}
+	treediff.attrsCache[tree.Hash] = rules
+	return rules, nil
+}
+
+// parseGitattributes parses the contents of a .gitattributes file found at `dir` (the empty
+// string for the repository root) into rules, keeping only the linguist-generated,
+// linguist-vendored and linguist-documentation attributes. Each pattern is compiled relative
+// to `dir`, matching the git rule that a .gitattributes file only governs paths underneath it.
+func parseGitattributes(dir, contents string) []gitattributeRule {
+	var rules []gitattributeRule
+	for _, line := range strings.Split(contents, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		rule := gitattributeRule{pattern: compileGitattributePattern(dir, fields[0])}
+		for _, attr := range fields[1:] {
+			name, value := attr, true
+			switch {
+			case strings.HasPrefix(attr, "-"):
+				name, value = attr[1:], false
+			case strings.Contains(attr, "="):
+				idx := strings.Index(attr, "=")
+				name, value = attr[:idx], attr[idx+1:] != "false"
+			}
+			v := value
+			switch name {
+			case "linguist-generated":
+				rule.generated = &v
+			case "linguist-vendored":
+				rule.vendored = &v
+			case "linguist-documentation":
+				rule.documentation = &v
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// isLinguistExcluded reports whether `path` is marked linguist-generated, linguist-vendored
+// or linguist-documentation by `rules`, applying them in order so later rules win.
+func isLinguistExcluded(rules []gitattributeRule, path string) bool {
+	var generated, vendored, documentation bool
+	for _, rule := range rules {
+		if !rule.pattern.matches(path) {
+			continue
+		}
+		if rule.generated != nil {
+			generated = *rule.generated
+		}
+		if rule.vendored != nil {
+			vendored = *rule.vendored
+		}
+		if rule.documentation != nil {
+			documentation = *rule.documentation
+		}
+	}
+	return generated || vendored || documentation
+}
+
+// compileGitattributePattern compiles a single .gitattributes pattern found in the
+// .gitattributes file located at `dir` (the empty string for the repository root) into a
+// globPattern matched against full repository-relative paths. An unanchored pattern (no "/")
+// still only applies underneath `dir`, so it is rewritten as `dir/**/pattern`; an anchored
+// pattern is simply rooted at `dir`.
+func compileGitattributePattern(dir, pattern string) globPattern {
+	compiled := compileGlobPattern(pattern)
+	segments := compiled.segments
+	if !compiled.anchored {
+		segments = append([]string{"**"}, segments...)
+	}
+	if dir != "" {
+		segments = append(strings.Split(dir, "/"), segments...)
+	}
+	return globPattern{segments: segments, anchored: true}
+}
+
+// detectRenames pairs up candidate deletes and adds in `diff` whose blob contents are similar
+// enough, replacing each matched pair with a single rename object.Change (From and To both
+// populated). Copies are not detected, since only deletes are paired with adds. It returns the resulting changes together with a map from each detected rename
+// change to its similarity score in percent [0, 100].
+//
+// Matching happens in two passes. The first resolves every byte-identical (same blob hash)
+// delete/add pair it can find, across the whole candidate set at once; doing this globally,
+// rather than inside the per-delete scoring loop below, means an exact match can never be lost
+// to an earlier delete that only happened to be merely similar to the same add. The second pass
+// scores whatever is left by blob similarity.
+func (treediff *TreeDiff) detectRenames(diff object.Changes) (object.Changes, map[*object.Change]int) {
+	renames := map[*object.Change]int{}
+	var deletes, adds, rest object.Changes
+	for _, change := range diff {
+		action, err := change.Action()
+		if err != nil {
+			rest = append(rest, change)
+			continue
+		}
+		switch action {
+		case merkletrie.Delete:
+			deletes = append(deletes, change)
+		case merkletrie.Insert:
+			adds = append(adds, change)
+		default:
+			rest = append(rest, change)
+		}
+	}
+	// blobCache is rebuilt from scratch for every call rather than reused across commits, so it
+	// never holds on to more than the blobs needed to score the current commit's renames.
+	treediff.blobCache = map[plumbing.Hash][]byte{}
+
+	addsByHash := map[plumbing.Hash][]int{}
+	for i, add := range adds {
+		h := add.To.TreeEntry.Hash
+		addsByHash[h] = append(addsByHash[h], i)
+	}
+	matchedDeletes := make(map[int]bool)
+	matchedAdds := make(map[int]bool)
+	for di, del := range deletes {
+		for _, ai := range addsByHash[del.From.TreeEntry.Hash] {
+			if matchedAdds[ai] {
+				continue
+			}
+			matchedDeletes[di] = true
+			matchedAdds[ai] = true
+			rename := &object.Change{From: del.From, To: adds[ai].To}
+			renames[rename] = 100
+			rest = append(rest, rename)
+			break
+		}
+	}
+
+	for di, del := range deletes {
+		if matchedDeletes[di] {
+			continue
+		}
+		bestScore := -1
+		bestIndex := -1
+		delBlob, err := treediff.blobContents(del.From.TreeEntry.Hash)
+		if err != nil {
+			rest = append(rest, del)
+			continue
+		}
+		for i, add := range adds {
+			if matchedAdds[i] {
+				continue
+			}
+			addBlob, err := treediff.blobContents(add.To.TreeEntry.Hash)
+			if err != nil {
+				continue
+			}
+			score := blobSimilarity(delBlob, addBlob)
+			if score > bestScore {
+				bestScore, bestIndex = score, i
+			}
+		}
+		if bestIndex >= 0 && bestScore >= treediff.RenameSimilarityThreshold {
+			matchedAdds[bestIndex] = true
+			rename := &object.Change{From: del.From, To: adds[bestIndex].To}
+			renames[rename] = bestScore
+			rest = append(rest, rename)
+		} else {
+			rest = append(rest, del)
+		}
+	}
+	for i, add := range adds {
+		if !matchedAdds[i] {
+			rest = append(rest, add)
+		}
+	}
+	return rest, renames
+}
+
+// blobContents returns the contents of the blob with the given hash, using treediff.blobCache
+// to avoid downloading the same blob more than once while scoring rename candidates.
+func (treediff *TreeDiff) blobContents(hash plumbing.Hash) ([]byte, error) {
+	if data, exists := treediff.blobCache[hash]; exists {
+		return data, nil
+	}
+	blob, err := treediff.repository.BlobObject(hash)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := blob.Reader()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	treediff.blobCache[hash] = data
+	return data, nil
+}
+
+// blobSimilarity estimates how similar two blobs are, as a percentage [0, 100], by comparing
+// the Jaccard index of their shingled lines. It is a cheap, order-insensitive approximation
+// good enough to rank rename candidates without a full diff.
+func blobSimilarity(a, b []byte) int {
+	if len(a) == 0 && len(b) == 0 {
+		return 100
+	}
+	shinglesA := shingleLines(a)
+	shinglesB := shingleLines(b)
+	if len(shinglesA) == 0 || len(shinglesB) == 0 {
+		return 0
+	}
+	intersection := 0
+	for shingle := range shinglesA {
+		if shinglesB[shingle] {
+			intersection++
+		}
+	}
+	union := len(shinglesA) + len(shinglesB) - intersection
+	if union == 0 {
+		return 100
+	}
+	return intersection * 100 / union
+}
+
+// shingleLines splits `data` into lines and returns the set of adjacent line pairs
+// ("shingles"), which, unlike a set of single lines, also reflects which lines are adjacent.
+func shingleLines(data []byte) map[string]bool {
+	lines := bytes.Split(data, []byte{'\n'})
+	shingles := make(map[string]bool, len(lines))
+	for i := 0; i+1 < len(lines); i++ {
+		shingles[string(lines[i])+"\n"+string(lines[i+1])] = true
+	}
+	if len(lines) == 1 {
+		shingles[string(lines[0])] = true
+	}
+	return shingles
 }
 
 func init() {
@@ -0,0 +1,334 @@
+package hercules
+
+import (
+	"testing"
+	"time"
+
+	"gopkg.in/src-d/go-billy.v4/memfs"
+	"gopkg.in/src-d/go-billy.v4/util"
+	git "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/storage/memory"
+)
+
+// testRepository creates an empty in-memory repository for tests that need to exercise
+// TreeDiff against real commits and trees instead of hand-built object.Change values.
+func testRepository(t *testing.T) *git.Repository {
+	t.Helper()
+	fs := memfs.New()
+	repo, err := git.Init(memory.NewStorage(), fs)
+	if err != nil {
+		t.Fatalf("git.Init() failed: %v", err)
+	}
+	return repo
+}
+
+// testCommit writes `files` (path -> contents) into the repository's worktree and commits
+// them, returning the resulting *object.Commit.
+func testCommit(t *testing.T, repo *git.Repository, files map[string]string, message string) *object.Commit {
+	t.Helper()
+	wt, err := repo.Worktree()
+	if err != nil {
+		t.Fatalf("Worktree() failed: %v", err)
+	}
+	for path, contents := range files {
+		if err := util.WriteFile(wt.Filesystem, path, []byte(contents), 0644); err != nil {
+			t.Fatalf("WriteFile(%q) failed: %v", path, err)
+		}
+		if _, err := wt.Add(path); err != nil {
+			t.Fatalf("Add(%q) failed: %v", path, err)
+		}
+	}
+	when := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	hash, err := wt.Commit(message, &git.CommitOptions{Author: &object.Signature{
+		Name: "test", Email: "test@example.com", When: when}})
+	if err != nil {
+		t.Fatalf("Commit() failed: %v", err)
+	}
+	commit, err := repo.CommitObject(hash)
+	if err != nil {
+		t.Fatalf("CommitObject() failed: %v", err)
+	}
+	return commit
+}
+
+func TestBlobSimilarity(t *testing.T) {
+	cases := []struct {
+		name string
+		a, b string
+		want int
+	}{
+		{"both empty", "", "", 100},
+		{"identical", "line1\nline2\nline3", "line1\nline2\nline3", 100},
+		{"completely different", "aaa\nbbb\nccc", "xxx\nyyy\nzzz", 0},
+		{"one empty", "aaa\nbbb", "", 0},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := blobSimilarity([]byte(c.a), []byte(c.b)); got != c.want {
+				t.Errorf("blobSimilarity(%q, %q) = %d, want %d", c.a, c.b, got, c.want)
+			}
+		})
+	}
+}
+
+func TestBlobSimilarityPartialOverlap(t *testing.T) {
+	a := "line1\nline2\nline3\nline4"
+	b := "line1\nline2\nline3\nchanged"
+	score := blobSimilarity([]byte(a), []byte(b))
+	if score <= 0 || score >= 100 {
+		t.Errorf("blobSimilarity(%q, %q) = %d, want a score strictly between 0 and 100", a, b, score)
+	}
+}
+
+func TestShingleLines(t *testing.T) {
+	shingles := shingleLines([]byte("a\nb\nc"))
+	if len(shingles) != 2 {
+		t.Fatalf("shingleLines(\"a\\nb\\nc\") produced %d shingles, want 2", len(shingles))
+	}
+	if !shingles["a\nb"] || !shingles["b\nc"] {
+		t.Errorf("shingleLines(\"a\\nb\\nc\") = %v, missing expected adjacent pairs", shingles)
+	}
+
+	single := shingleLines([]byte("onlyline"))
+	if len(single) != 1 || !single["onlyline"] {
+		t.Errorf("shingleLines(\"onlyline\") = %v, want a single shingle of the whole line", single)
+	}
+}
+
+func TestGlobPatternMatches(t *testing.T) {
+	cases := []struct {
+		pattern, path string
+		want          bool
+	}{
+		{"backend/**", "backend/a/b/c.go", true},
+		{"backend/**", "backend/file.go", true},
+		{"backend/**", "frontend/file.go", false},
+		{"vendor/*", "vendor/file.go", true},
+		{"vendor/*", "vendor/sub/file.go", false},
+		{"*.go", "main.go", true},
+		{"*.go", "pkg/sub/main.go", true},
+		{"*.go", "main.txt", false},
+	}
+	for _, c := range cases {
+		t.Run(c.pattern+"_"+c.path, func(t *testing.T) {
+			if got := compileGlobPattern(c.pattern).matches(c.path); got != c.want {
+				t.Errorf("compileGlobPattern(%q).matches(%q) = %v, want %v", c.pattern, c.path, got, c.want)
+			}
+		})
+	}
+}
+
+func TestGlobPatternCanMatchPrefix(t *testing.T) {
+	if !compileGlobPattern("backend/**").canMatchPrefix([]string{"backend"}) {
+		t.Error(`compileGlobPattern("backend/**").canMatchPrefix(["backend"]) = false, want true`)
+	}
+	if compileGlobPattern("backend/**").canMatchPrefix([]string{"frontend"}) {
+		t.Error(`compileGlobPattern("backend/**").canMatchPrefix(["frontend"]) = true, want false`)
+	}
+	if !compileGlobPattern("*.go").canMatchPrefix([]string{"anything"}) {
+		t.Error(`compileGlobPattern("*.go").canMatchPrefix(["anything"]) = false, want true (unanchored)`)
+	}
+}
+
+func TestParseGitattributesAndIsLinguistExcluded(t *testing.T) {
+	contents := "" +
+		"vendor/** linguist-vendored\n" +
+		"vendor/keep/** -linguist-vendored\n" +
+		"generated.go linguist-generated\n" +
+		"docs/** linguist-documentation\n" +
+		"# a comment\n" +
+		"\n" +
+		"src/** linguist-vendored\n"
+	rules := parseGitattributes("", contents)
+
+	cases := []struct {
+		path string
+		want bool
+	}{
+		{"vendor/sub/file.go", true},
+		{"vendor/keep/sub/file.go", false},
+		{"generated.go", true},
+		{"pkg/generated.go", true},
+		{"docs/readme.md", true},
+		{"src/main.go", true},
+		{"other/main.go", false},
+	}
+	for _, c := range cases {
+		t.Run(c.path, func(t *testing.T) {
+			if got := isLinguistExcluded(rules, c.path); got != c.want {
+				t.Errorf("isLinguistExcluded(rules, %q) = %v, want %v", c.path, got, c.want)
+			}
+		})
+	}
+}
+
+func TestParseGitattributesValueAssignment(t *testing.T) {
+	contents := "" +
+		"generated.go linguist-generated=false\n" +
+		"vendored.go linguist-vendored=true\n" +
+		"other.go linguist-generated=weird\n"
+	rules := parseGitattributes("", contents)
+
+	cases := []struct {
+		path string
+		want bool
+	}{
+		{"generated.go", false},
+		{"vendored.go", true},
+		{"other.go", true},
+	}
+	for _, c := range cases {
+		t.Run(c.path, func(t *testing.T) {
+			if got := isLinguistExcluded(rules, c.path); got != c.want {
+				t.Errorf("isLinguistExcluded(rules, %q) = %v, want %v", c.path, got, c.want)
+			}
+		})
+	}
+}
+
+func TestLinguistAttrsNestedGitattributesMostSpecificWins(t *testing.T) {
+	root := parseGitattributes("", "vendor/** linguist-vendored\n")
+	nested := parseGitattributes("vendor/keep", "** -linguist-vendored\n")
+	rules := append(root, nested...)
+
+	cases := []struct {
+		path string
+		want bool
+	}{
+		{"vendor/sub/file.go", true},
+		{"vendor/keep/file.go", false},
+		{"vendor/keep/sub/file.go", false},
+	}
+	for _, c := range cases {
+		t.Run(c.path, func(t *testing.T) {
+			if got := isLinguistExcluded(rules, c.path); got != c.want {
+				t.Errorf("isLinguistExcluded(rules, %q) = %v, want %v", c.path, got, c.want)
+			}
+		})
+	}
+}
+
+func TestDetectRenamesGlobalExactMatchBeatsGreedySimilarity(t *testing.T) {
+	repo := testRepository(t)
+	// bbb_old.go and ccc_new.go are byte-identical (an exact rename); aaa_old.go merely
+	// resembles them (one changed line). aaa_old.go sorts first, so a delete-order-greedy
+	// matcher would let it claim ccc_new.go by similarity before bbb_old.go ever gets a
+	// chance at its exact match.
+	contentA := "line1\nline2\nline3\nline4\nline5\nline6\nline7\nline8\nline9\n"
+	contentB := "line1\nline2\nline3\nline4\nline5\nline6\nline7\nline8\nCHANGED\n"
+	commit1 := testCommit(t, repo, map[string]string{
+		"aaa_old.go": contentA,
+		"bbb_old.go": contentB,
+	}, "initial")
+
+	wt, err := repo.Worktree()
+	if err != nil {
+		t.Fatalf("Worktree() failed: %v", err)
+	}
+	if _, err := wt.Remove("aaa_old.go"); err != nil {
+		t.Fatalf("Remove(aaa_old.go) failed: %v", err)
+	}
+	if _, err := wt.Remove("bbb_old.go"); err != nil {
+		t.Fatalf("Remove(bbb_old.go) failed: %v", err)
+	}
+	commit2 := testCommit(t, repo, map[string]string{"ccc_new.go": contentB}, "rename")
+
+	treediff := &TreeDiff{DetectRenames: true, RenameSimilarityThreshold: DefaultRenameSimilarityThreshold}
+	treediff.Initialize(repo)
+	if _, err := treediff.Consume(map[string]interface{}{"commit": commit1}); err != nil {
+		t.Fatalf("Consume(commit1) failed: %v", err)
+	}
+	result, err := treediff.Consume(map[string]interface{}{"commit": commit2})
+	if err != nil {
+		t.Fatalf("Consume(commit2) failed: %v", err)
+	}
+	diff := result[DependencyTreeChanges].(object.Changes)
+	renames := result[DependencyRenames].(map[*object.Change]int)
+
+	var renamedFromB, plainDeleteA bool
+	for _, change := range diff {
+		if change.From.Name == "bbb_old.go" && change.To.Name == "ccc_new.go" {
+			renamedFromB = true
+			if score := renames[change]; score != 100 {
+				t.Errorf("rename score for bbb_old.go -> ccc_new.go = %d, want 100 (exact match)", score)
+			}
+		}
+		if change.From.Name == "aaa_old.go" && change.To.Name == "ccc_new.go" {
+			t.Errorf("aaa_old.go was paired with ccc_new.go by similarity, stealing it from bbb_old.go's exact match")
+		}
+		if change.From.Name == "aaa_old.go" && change.To.Name == "" {
+			plainDeleteA = true
+		}
+	}
+	if !renamedFromB {
+		t.Error("expected bbb_old.go to be detected as an exact-match rename to ccc_new.go")
+	}
+	if !plainDeleteA {
+		t.Error("expected aaa_old.go to remain a plain delete once its only similarity candidate was claimed by the exact match")
+	}
+}
+
+func TestConsumeWithBaseHashAndModification(t *testing.T) {
+	repo := testRepository(t)
+	base := testCommit(t, repo, map[string]string{"keep.go": "unchanged\n", "mod.go": "before\n"}, "base")
+	next := testCommit(t, repo, map[string]string{"mod.go": "after\n", "new.go": "added\n"}, "next")
+
+	treediff := &TreeDiff{BaseHash: base.Hash.String()}
+	treediff.Initialize(repo)
+	result, err := treediff.Consume(map[string]interface{}{"commit": next})
+	if err != nil {
+		t.Fatalf("Consume() failed: %v", err)
+	}
+	diff := result[DependencyTreeChanges].(object.Changes)
+
+	var sawModify, sawAdd, sawKeepUnchanged bool
+	for _, change := range diff {
+		switch {
+		case change.From.Name == "mod.go" && change.To.Name == "mod.go":
+			sawModify = true
+		case change.To.Name == "new.go":
+			sawAdd = true
+		case change.From.Name == "keep.go" || change.To.Name == "keep.go":
+			sawKeepUnchanged = true
+		}
+	}
+	if !sawModify {
+		t.Error("expected mod.go to appear as a modification against BaseHash's tree")
+	}
+	if !sawAdd {
+		t.Error("expected new.go to appear as an addition")
+	}
+	if sawKeepUnchanged {
+		t.Error("keep.go did not change between base and next and should not appear in the diff")
+	}
+}
+
+func TestChangeNames(t *testing.T) {
+	add := &object.Change{To: object.ChangeEntry{Name: "new.go"}}
+	if names := changeNames(add); len(names) != 1 || names[0] != "new.go" {
+		t.Errorf("changeNames(add) = %v, want [new.go]", names)
+	}
+
+	del := &object.Change{From: object.ChangeEntry{Name: "old.go"}}
+	if names := changeNames(del); len(names) != 1 || names[0] != "old.go" {
+		t.Errorf("changeNames(del) = %v, want [old.go]", names)
+	}
+
+	rename := &object.Change{From: object.ChangeEntry{Name: "old.go"}, To: object.ChangeEntry{Name: "new.go"}}
+	if names := changeNames(rename); len(names) != 2 {
+		t.Errorf("changeNames(rename) = %v, want both old.go and new.go", names)
+	}
+}
+
+func TestAnyHasPrefix(t *testing.T) {
+	if !anyHasPrefix([]string{"backend/main.go"}, []string{"frontend/", "backend/"}) {
+		t.Error("anyHasPrefix should find the matching prefix")
+	}
+	if anyHasPrefix([]string{"docs/readme.md"}, []string{"frontend/", "backend/"}) {
+		t.Error("anyHasPrefix should not match an unrelated path")
+	}
+	if anyHasPrefix(nil, []string{"backend/"}) {
+		t.Error("anyHasPrefix with no names should not match anything")
+	}
+}